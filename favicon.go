@@ -0,0 +1,442 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/html"
+)
+
+// faviconCandidate is one possible icon turned up by a discovery strategy.
+// Width and Height are the best guess at the icon's pixel dimensions; either
+// may be zero when a strategy has no size information to offer.
+type faviconCandidate struct {
+	URL      string
+	Width    int
+	Height   int
+	MimeType string
+}
+
+// recognizedIconRels are the <link rel="..."> values discovery treats as
+// icon references.
+var recognizedIconRels = []string{
+	"icon",
+	"shortcut icon",
+	"apple-touch-icon",
+	"apple-touch-icon-precomposed",
+	"mask-icon",
+}
+
+// commonFaviconPaths are probed, in order, as a last resort when no
+// candidate turns up anywhere in the page's HTML.
+var commonFaviconPaths = []string{
+	"/favicon.ico",
+	"/favicon.png",
+	"/favicon.svg",
+	"/apple-touch-icon.png",
+	"/apple-touch-icon-precomposed.png",
+}
+
+// discoverFaviconCandidates runs every discovery strategy in priority order
+// and returns every candidate turned up. og:image and common-path probing
+// are both last resorts that only run when the more authoritative
+// strategies (link tags, manifest) found nothing: og:image is usually a
+// large social-share banner with no declared icon semantics, so letting it
+// compete directly against a real favicon would let the ranker's
+// size-based scoring pick the banner over the site's actual icon; and
+// common-path probing costs a round trip per path. baseURL should be the
+// page's post-redirect URL, so relative hrefs resolve against where the
+// page actually ended up.
+func discoverFaviconCandidates(ctx context.Context, htmlContent string, baseURL *url.URL) []faviconCandidate {
+	var candidates []faviconCandidate
+
+	candidates = append(candidates, linkIconCandidates(htmlContent, baseURL)...)
+	candidates = append(candidates, manifestCandidates(ctx, htmlContent, baseURL)...)
+
+	if len(candidates) == 0 {
+		candidates = append(candidates, openGraphCandidates(htmlContent, baseURL)...)
+	}
+
+	if len(candidates) == 0 {
+		candidates = append(candidates, commonPathCandidates(ctx, baseURL)...)
+	}
+
+	return candidates
+}
+
+// parseHTMLForFavicon runs the full discovery pipeline against a page,
+// inspects the dimensions of any candidate whose size isn't already known,
+// and returns the best one's URL, falling back to the conventional
+// /favicon.ico path when nothing is found. minSize, if positive, excludes
+// candidates known to fall below it in either dimension.
+func parseHTMLForFavicon(ctx context.Context, htmlContent string, baseURL *url.URL, minSize int) (string, error) {
+	candidates := discoverFaviconCandidates(ctx, htmlContent, baseURL)
+	candidates = inspectCandidateSizes(ctx, candidates)
+	candidates = filterCandidatesByMinSize(candidates, minSize)
+
+	best, ok := rankFaviconCandidates(candidates)
+	if !ok {
+		return resolveHref("/favicon.ico", baseURL), nil
+	}
+
+	return best.URL, nil
+}
+
+// linkIconCandidates walks the document for <link rel="..."> icon
+// references and <meta name="msapplication-TileImage"> tags.
+func linkIconCandidates(htmlContent string, baseURL *url.URL) []faviconCandidate {
+	doc, err := html.Parse(strings.NewReader(htmlContent))
+	if err != nil {
+		return nil
+	}
+
+	var candidates []faviconCandidate
+	var walk func(*html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.ElementNode {
+			switch n.Data {
+			case "link":
+				if c, ok := linkIconCandidate(n.Attr, baseURL); ok {
+					candidates = append(candidates, c)
+				}
+			case "meta":
+				if c, ok := tileImageCandidate(n.Attr, baseURL); ok {
+					candidates = append(candidates, c)
+				}
+			}
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(doc)
+
+	return candidates
+}
+
+func linkIconCandidate(attrs []html.Attribute, baseURL *url.URL) (faviconCandidate, bool) {
+	var rel, href, sizesAttr, mimeType string
+	for _, attr := range attrs {
+		switch attr.Key {
+		case "rel":
+			rel = attr.Val
+		case "href":
+			href = attr.Val
+		case "sizes":
+			sizesAttr = attr.Val
+		case "type":
+			mimeType = attr.Val
+		}
+	}
+
+	if href == "" || !isIconRel(rel) {
+		return faviconCandidate{}, false
+	}
+
+	w, h := parseSizes(sizesAttr)
+	return faviconCandidate{
+		URL:      resolveHref(href, baseURL),
+		Width:    w,
+		Height:   h,
+		MimeType: mimeType,
+	}, true
+}
+
+func tileImageCandidate(attrs []html.Attribute, baseURL *url.URL) (faviconCandidate, bool) {
+	var name, content string
+	for _, attr := range attrs {
+		switch attr.Key {
+		case "name":
+			name = attr.Val
+		case "content":
+			content = attr.Val
+		}
+	}
+
+	if content == "" || !strings.EqualFold(name, "msapplication-TileImage") {
+		return faviconCandidate{}, false
+	}
+
+	return faviconCandidate{URL: resolveHref(content, baseURL)}, true
+}
+
+func isIconRel(rel string) bool {
+	rel = strings.ToLower(strings.TrimSpace(rel))
+	for _, recognized := range recognizedIconRels {
+		if rel == recognized || strings.Contains(rel, recognized) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseSizes parses a <link sizes="..."> attribute, which may list several
+// space-separated WxH pairs (or "any"), and returns the largest one.
+func parseSizes(sizesAttr string) (width, height int) {
+	best := 0
+	for _, token := range strings.Fields(sizesAttr) {
+		if strings.EqualFold(token, "any") {
+			continue
+		}
+
+		parts := strings.SplitN(strings.ToLower(token), "x", 2)
+		if len(parts) != 2 {
+			continue
+		}
+
+		w, errW := strconv.Atoi(parts[0])
+		h, errH := strconv.Atoi(parts[1])
+		if errW != nil || errH != nil {
+			continue
+		}
+
+		if area := w * h; area > best {
+			best, width, height = area, w, h
+		}
+	}
+
+	return width, height
+}
+
+// webManifest is the subset of the Web App Manifest format
+// (manifest.webmanifest / manifest.json) that discovery cares about.
+type webManifest struct {
+	Icons []struct {
+		Src   string `json:"src"`
+		Sizes string `json:"sizes"`
+		Type  string `json:"type"`
+	} `json:"icons"`
+}
+
+// manifestCandidates follows a <link rel="manifest"> reference and returns
+// the largest icon listed in its icons[] array, if any.
+func manifestCandidates(ctx context.Context, htmlContent string, baseURL *url.URL) []faviconCandidate {
+	manifestHref := findManifestHref(htmlContent)
+	if manifestHref == "" {
+		return nil
+	}
+
+	manifestURL, err := url.Parse(resolveHref(manifestHref, baseURL))
+	if err != nil {
+		return nil
+	}
+
+	body, err := fetchBytes(ctx, manifestURL.String())
+	if err != nil {
+		return nil
+	}
+
+	var manifest webManifest
+	if err := json.Unmarshal(body, &manifest); err != nil {
+		return nil
+	}
+
+	var best faviconCandidate
+	bestArea := -1
+	for _, icon := range manifest.Icons {
+		w, h := parseSizes(icon.Sizes)
+		if area := w * h; area > bestArea {
+			bestArea = area
+			best = faviconCandidate{
+				URL:      resolveHref(icon.Src, manifestURL),
+				Width:    w,
+				Height:   h,
+				MimeType: icon.Type,
+			}
+		}
+	}
+
+	if bestArea < 0 {
+		return nil
+	}
+
+	return []faviconCandidate{best}
+}
+
+func findManifestHref(htmlContent string) string {
+	doc, err := html.Parse(strings.NewReader(htmlContent))
+	if err != nil {
+		return ""
+	}
+
+	var manifestHref string
+	var walk func(*html.Node)
+	walk = func(n *html.Node) {
+		if manifestHref != "" {
+			return
+		}
+		if n.Type == html.ElementNode && n.Data == "link" {
+			var rel, href string
+			for _, attr := range n.Attr {
+				switch attr.Key {
+				case "rel":
+					rel = attr.Val
+				case "href":
+					href = attr.Val
+				}
+			}
+			if strings.EqualFold(rel, "manifest") && href != "" {
+				manifestHref = href
+				return
+			}
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(doc)
+
+	return manifestHref
+}
+
+// openGraphCandidates returns the page's og:image as a last-resort logo
+// hint, used only when nothing more specific is found.
+func openGraphCandidates(htmlContent string, baseURL *url.URL) []faviconCandidate {
+	doc, err := html.Parse(strings.NewReader(htmlContent))
+	if err != nil {
+		return nil
+	}
+
+	var ogImage string
+	var walk func(*html.Node)
+	walk = func(n *html.Node) {
+		if ogImage != "" {
+			return
+		}
+		if n.Type == html.ElementNode && n.Data == "meta" {
+			var property, content string
+			for _, attr := range n.Attr {
+				switch attr.Key {
+				case "property":
+					property = attr.Val
+				case "content":
+					content = attr.Val
+				}
+			}
+			if strings.EqualFold(property, "og:image") && content != "" {
+				ogImage = content
+				return
+			}
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(doc)
+
+	if ogImage == "" {
+		return nil
+	}
+
+	return []faviconCandidate{{URL: resolveHref(ogImage, baseURL)}}
+}
+
+// commonPathCandidates probes a fixed list of conventional favicon paths
+// with HEAD requests and returns the first one that responds 200. Each
+// probe goes through the same fetchSemaphore/fetchHostLimiter gating as the
+// other fetch paths, since a batch of URLs with no discoverable icon
+// anywhere else would otherwise hit the same host with 5 un-throttled
+// requests apiece, and through newGuardedHTTPClient like every other
+// fetch path (SSRF guard).
+func commonPathCandidates(ctx context.Context, baseURL *url.URL) []faviconCandidate {
+	client := newGuardedHTTPClient(5 * time.Second)
+
+	for _, path := range commonFaviconPaths {
+		candidateURL := resolveHref(path, baseURL)
+
+		release, err := acquireFetchSlot(ctx)
+		if err != nil {
+			return nil
+		}
+
+		if err := fetchHostLimiter.wait(ctx, baseURL.Hostname()); err != nil {
+			release()
+			return nil
+		}
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodHead, candidateURL, nil)
+		if err != nil {
+			release()
+			continue
+		}
+
+		resp, err := client.Do(req)
+		release()
+		if err != nil {
+			continue
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode == http.StatusOK {
+			return []faviconCandidate{{URL: candidateURL, MimeType: resp.Header.Get("Content-Type")}}
+		}
+	}
+
+	return nil
+}
+
+// resolveHref joins a possibly relative href against baseURL, correctly
+// handling protocol-relative ("//cdn..."), root-relative ("/favicon.png"),
+// and path-relative ("../img/icon.png") forms per RFC 3986.
+func resolveHref(href string, baseURL *url.URL) string {
+	ref, err := url.Parse(href)
+	if err != nil {
+		return href
+	}
+	return baseURL.ResolveReference(ref).String()
+}
+
+// maxManifestBytes caps how much of a fetched manifest is read, so a
+// manifest href pointed at a huge response can't be used as a
+// memory-exhaustion DoS.
+const maxManifestBytes = 1 * 1024 * 1024
+
+// fetchBytes fetches the raw bytes at rawURL, used for manifest downloads.
+// Like the other fetch paths, it is gated by fetchSemaphore and
+// fetchHostLimiter before hitting the network, and rawURL (plus every
+// redirect hop) is dialed through newGuardedHTTPClient, since a manifest
+// href comes from attacker-controlled page content and must not be usable
+// to reach internal hosts (SSRF).
+func fetchBytes(ctx context.Context, rawURL string) ([]byte, error) {
+	parsedURL, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	release, err := acquireFetchSlot(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	if err := fetchHostLimiter.wait(ctx, parsedURL.Hostname()); err != nil {
+		return nil, err
+	}
+
+	client := newGuardedHTTPClient(10 * time.Second)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch %s, status code: %d", rawURL, resp.StatusCode)
+	}
+
+	return ioutil.ReadAll(io.LimitReader(resp.Body, maxManifestBytes))
+}
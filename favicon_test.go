@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+// withLoopbackFetchesAllowed lets a test hit an httptest.Server, which
+// listens on loopback, without relaxing guardedDialContext for the rest of
+// the suite.
+func withLoopbackFetchesAllowed(t *testing.T) {
+	t.Helper()
+	allowLoopbackFetches = true
+	t.Cleanup(func() { allowLoopbackFetches = false })
+}
+
+func TestResolveHref(t *testing.T) {
+	cases := []struct {
+		name string
+		base string
+		href string
+		want string
+	}{
+		{
+			name: "root-relative href against https base after http to https upgrade",
+			base: "https://example.com/",
+			href: "/static/icon.png",
+			want: "https://example.com/static/icon.png",
+		},
+		{
+			name: "root-relative href against www-subdomain redirect target",
+			base: "https://www.example.com/",
+			href: "/favicon.ico",
+			want: "https://www.example.com/favicon.ico",
+		},
+		{
+			name: "protocol-relative href",
+			base: "https://example.com/",
+			href: "//cdn.example.com/icon.png",
+			want: "https://cdn.example.com/icon.png",
+		},
+		{
+			name: "relative href with parent directory traversal",
+			base: "https://example.com/en/home",
+			href: "../img/icon.png",
+			want: "https://example.com/img/icon.png",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			base, err := url.Parse(tc.base)
+			if err != nil {
+				t.Fatalf("failed to parse base URL: %v", err)
+			}
+
+			got := resolveHref(tc.href, base)
+			if got != tc.want {
+				t.Errorf("resolveHref(%q, %q) = %q, want %q", tc.href, tc.base, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestParseHTMLForFaviconUsesPostRedirectBase(t *testing.T) {
+	base, err := url.Parse("https://www.example.com/en/")
+	if err != nil {
+		t.Fatalf("failed to parse base URL: %v", err)
+	}
+
+	htmlContent := `<html><head><link rel="icon" href="../img/icon.png" sizes="32x32"></head></html>`
+
+	got, err := parseHTMLForFavicon(nil, htmlContent, base, 0)
+	if err != nil {
+		t.Fatalf("parseHTMLForFavicon returned error: %v", err)
+	}
+
+	want := "https://www.example.com/img/icon.png"
+	if got != want {
+		t.Errorf("parseHTMLForFavicon() = %q, want %q", got, want)
+	}
+}
+
+func TestLinkIconCandidatesRecognizesAppleTouchAndMaskIcon(t *testing.T) {
+	base, err := url.Parse("https://example.com/")
+	if err != nil {
+		t.Fatalf("failed to parse base URL: %v", err)
+	}
+
+	htmlContent := `<html><head>
+		<link rel="apple-touch-icon" href="/apple-touch-icon.png" sizes="180x180">
+		<link rel="mask-icon" href="/mask-icon.svg" color="#000000">
+		<meta name="msapplication-TileImage" content="/tile.png">
+	</head></html>`
+
+	candidates := linkIconCandidates(htmlContent, base)
+
+	want := map[string]bool{
+		"https://example.com/apple-touch-icon.png": false,
+		"https://example.com/mask-icon.svg":        false,
+		"https://example.com/tile.png":             false,
+	}
+	for _, c := range candidates {
+		if _, ok := want[c.URL]; !ok {
+			t.Errorf("unexpected candidate %q", c.URL)
+			continue
+		}
+		want[c.URL] = true
+	}
+	for url, seen := range want {
+		if !seen {
+			t.Errorf("expected a candidate for %q, got none", url)
+		}
+	}
+
+	for _, c := range candidates {
+		if c.URL == "https://example.com/apple-touch-icon.png" && (c.Width != 180 || c.Height != 180) {
+			t.Errorf("apple-touch-icon size = %dx%d, want 180x180", c.Width, c.Height)
+		}
+	}
+}
+
+func TestFindManifestHref(t *testing.T) {
+	cases := []struct {
+		name string
+		html string
+		want string
+	}{
+		{
+			name: "manifest link present",
+			html: `<html><head><link rel="manifest" href="/site.webmanifest"></head></html>`,
+			want: "/site.webmanifest",
+		},
+		{
+			name: "no manifest link",
+			html: `<html><head><link rel="icon" href="/favicon.ico"></head></html>`,
+			want: "",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := findManifestHref(tc.html); got != tc.want {
+				t.Errorf("findManifestHref() = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestOpenGraphCandidatesOnlyUsedAsFallback(t *testing.T) {
+	base, err := url.Parse("https://example.com/")
+	if err != nil {
+		t.Fatalf("failed to parse base URL: %v", err)
+	}
+
+	htmlWithIconAndOGImage := `<html><head>
+		<link rel="icon" href="/favicon.png" sizes="32x32">
+		<meta property="og:image" content="/social-banner.png">
+	</head></html>`
+
+	candidates := discoverFaviconCandidates(context.Background(), htmlWithIconAndOGImage, base)
+	for _, c := range candidates {
+		if c.URL == "https://example.com/social-banner.png" {
+			t.Errorf("discoverFaviconCandidates() included the og:image banner even though a <link rel=icon> was present")
+		}
+	}
+
+	htmlWithOnlyOGImage := `<html><head>
+		<meta property="og:image" content="/social-banner.png">
+	</head></html>`
+
+	candidates = discoverFaviconCandidates(context.Background(), htmlWithOnlyOGImage, base)
+	found := false
+	for _, c := range candidates {
+		if c.URL == "https://example.com/social-banner.png" {
+			found = true
+		}
+	}
+	if !found {
+		t.Error("discoverFaviconCandidates() dropped the og:image banner even though nothing better was found")
+	}
+}
+
+func TestManifestCandidatesFetchesIconsFromManifest(t *testing.T) {
+	withLoopbackFetchesAllowed(t)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/site.webmanifest", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"icons":[
+			{"src":"/icon-48.png","sizes":"48x48","type":"image/png"},
+			{"src":"/icon-192.png","sizes":"192x192","type":"image/png"}
+		]}`)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	base, err := url.Parse(server.URL + "/")
+	if err != nil {
+		t.Fatalf("failed to parse base URL: %v", err)
+	}
+
+	htmlContent := `<html><head><link rel="manifest" href="/site.webmanifest"></head></html>`
+
+	candidates := manifestCandidates(context.Background(), htmlContent, base)
+	if len(candidates) != 1 {
+		t.Fatalf("manifestCandidates() returned %d candidates, want 1", len(candidates))
+	}
+
+	want := server.URL + "/icon-192.png"
+	if candidates[0].URL != want {
+		t.Errorf("manifestCandidates() picked %q, want the largest icon %q", candidates[0].URL, want)
+	}
+}
+
+func TestCommonPathCandidatesProbesConventionalPaths(t *testing.T) {
+	withLoopbackFetchesAllowed(t)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/favicon.ico", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/x-icon")
+		w.WriteHeader(http.StatusOK)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	base, err := url.Parse(server.URL + "/")
+	if err != nil {
+		t.Fatalf("failed to parse base URL: %v", err)
+	}
+
+	candidates := commonPathCandidates(context.Background(), base)
+	if len(candidates) != 1 {
+		t.Fatalf("commonPathCandidates() returned %d candidates, want 1", len(candidates))
+	}
+
+	want := server.URL + "/favicon.ico"
+	if candidates[0].URL != want {
+		t.Errorf("commonPathCandidates() = %q, want %q", candidates[0].URL, want)
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// targetIconSize is the dimension beyond which a larger icon stops
+	// mattering - a 512x512 icon is no better than a 256x256 one for our
+	// purposes, so both score the same.
+	targetIconSize = 256
+
+	// maxSizeInspections bounds how many candidates without a declared
+	// size are downloaded concurrently to learn their real dimensions.
+	maxSizeInspections = 4
+
+	// maxProbeBytes caps how much of a candidate image is read while
+	// probing its dimensions.
+	maxProbeBytes = 64 * 1024
+)
+
+var svgDimensionPattern = regexp.MustCompile(`(?i)<svg\b[^>]*\bwidth="([0-9.]+)"[^>]*\bheight="([0-9.]+)"`)
+
+// inspectCandidateSizes fills in Width/Height for candidates that have no
+// declared size, by downloading (bounded concurrently) and decoding just
+// enough of each image to read its dimensions. Candidates that already
+// have a declared size, or whose dimensions can't be determined, are left
+// as-is.
+func inspectCandidateSizes(ctx context.Context, candidates []faviconCandidate) []faviconCandidate {
+	sem := make(chan struct{}, maxSizeInspections)
+	var wg sync.WaitGroup
+
+	for i := range candidates {
+		if candidates[i].Width > 0 && candidates[i].Height > 0 {
+			continue
+		}
+
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			w, h, mimeType, ok := probeImageDimensions(ctx, candidates[i].URL)
+			if !ok {
+				return
+			}
+			candidates[i].Width = w
+			candidates[i].Height = h
+			if candidates[i].MimeType == "" {
+				candidates[i].MimeType = mimeType
+			}
+		}(i)
+	}
+
+	wg.Wait()
+	return candidates
+}
+
+// probeImageDimensions downloads just enough of the image at imageURL to
+// learn its dimensions. PNG, JPEG, and GIF are decoded via
+// image.DecodeConfig; SVG has no registered decoder, so its width/height
+// attributes are read with a regex instead. Like the other fetch paths, the
+// download is gated by fetchSemaphore and fetchHostLimiter, so the up-to-
+// maxSizeInspections concurrent probes per page can't bypass the batch-wide
+// fetch cap or hammer a host, and imageURL (plus every redirect hop) is
+// dialed through newGuardedHTTPClient (SSRF guard).
+func probeImageDimensions(ctx context.Context, imageURL string) (width, height int, mimeType string, ok bool) {
+	parsedURL, err := url.Parse(imageURL)
+	if err != nil {
+		return 0, 0, "", false
+	}
+
+	release, err := acquireFetchSlot(ctx)
+	if err != nil {
+		return 0, 0, "", false
+	}
+	defer release()
+
+	if err := fetchHostLimiter.wait(ctx, parsedURL.Hostname()); err != nil {
+		return 0, 0, "", false
+	}
+
+	client := newGuardedHTTPClient(5 * time.Second)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, imageURL, nil)
+	if err != nil {
+		return 0, 0, "", false
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, 0, "", false
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, 0, "", false
+	}
+
+	contentType := resp.Header.Get("Content-Type")
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxProbeBytes))
+	if err != nil {
+		return 0, 0, "", false
+	}
+
+	if strings.Contains(contentType, "svg") || strings.HasSuffix(strings.ToLower(imageURL), ".svg") {
+		m := svgDimensionPattern.FindSubmatch(data)
+		if m == nil {
+			return 0, 0, "image/svg+xml", false
+		}
+		w, errW := strconv.ParseFloat(string(m[1]), 64)
+		h, errH := strconv.ParseFloat(string(m[2]), 64)
+		if errW != nil || errH != nil {
+			return 0, 0, "image/svg+xml", false
+		}
+		return int(w), int(h), "image/svg+xml", true
+	}
+
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return 0, 0, contentType, false
+	}
+
+	return cfg.Width, cfg.Height, contentType, true
+}
+
+// filterCandidatesByMinSize drops candidates known to fall below minSize in
+// either dimension. Candidates whose size couldn't be determined are kept,
+// since rejecting them outright would be more likely to throw away a
+// perfectly good icon than to let through a tiny one.
+func filterCandidatesByMinSize(candidates []faviconCandidate, minSize int) []faviconCandidate {
+	if minSize <= 0 {
+		return candidates
+	}
+
+	var filtered []faviconCandidate
+	for _, c := range candidates {
+		if c.Width > 0 && c.Height > 0 && (c.Width < minSize || c.Height < minSize) {
+			continue
+		}
+		filtered = append(filtered, c)
+	}
+
+	return filtered
+}
+
+// rankFaviconCandidates picks the best candidate, preferring the largest
+// declared size (capped at targetIconSize) and breaking ties with a format
+// preference of SVG > PNG > ICO > JPEG. The first candidate seen wins
+// outright ties, so earlier, more authoritative strategies (link tags,
+// manifest) still win over later hints (og:image) when scores match.
+func rankFaviconCandidates(candidates []faviconCandidate) (faviconCandidate, bool) {
+	if len(candidates) == 0 {
+		return faviconCandidate{}, false
+	}
+
+	best := candidates[0]
+	bestScore := candidateScore(best)
+	for _, c := range candidates[1:] {
+		if score := candidateScore(c); score > bestScore {
+			best = c
+			bestScore = score
+		}
+	}
+
+	return best, true
+}
+
+func candidateScore(c faviconCandidate) int {
+	return cappedDimension(c)*10 + formatWeight(c)
+}
+
+func cappedDimension(c faviconCandidate) int {
+	d := c.Width
+	if c.Height > d {
+		d = c.Height
+	}
+	if d > targetIconSize {
+		d = targetIconSize
+	}
+	return d
+}
+
+func formatWeight(c faviconCandidate) int {
+	signal := strings.ToLower(c.MimeType + " " + c.URL)
+	switch {
+	case strings.Contains(signal, "svg"):
+		return 4
+	case strings.Contains(signal, "png"):
+		return 3
+	case strings.Contains(signal, "ico"):
+		return 2
+	case strings.Contains(signal, "jpeg"), strings.Contains(signal, "jpg"):
+		return 1
+	default:
+		return 0
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import "testing"
+
+func TestRankFaviconCandidatesPrefersLargerCappedSize(t *testing.T) {
+	candidates := []faviconCandidate{
+		{URL: "https://example.com/16.png", Width: 16, Height: 16, MimeType: "image/png"},
+		{URL: "https://example.com/512.png", Width: 512, Height: 512, MimeType: "image/png"},
+	}
+
+	best, ok := rankFaviconCandidates(candidates)
+	if !ok {
+		t.Fatal("rankFaviconCandidates returned ok=false for non-empty input")
+	}
+	if best.URL != "https://example.com/512.png" {
+		t.Errorf("best = %q, want the 512x512 icon", best.URL)
+	}
+}
+
+func TestRankFaviconCandidatesBreaksSizeTiesByFormat(t *testing.T) {
+	candidates := []faviconCandidate{
+		{URL: "https://example.com/icon.jpg", Width: 256, Height: 256, MimeType: "image/jpeg"},
+		{URL: "https://example.com/icon.svg", Width: 256, Height: 256, MimeType: "image/svg+xml"},
+		{URL: "https://example.com/icon.png", Width: 256, Height: 256, MimeType: "image/png"},
+	}
+
+	best, ok := rankFaviconCandidates(candidates)
+	if !ok {
+		t.Fatal("rankFaviconCandidates returned ok=false for non-empty input")
+	}
+	if best.URL != "https://example.com/icon.svg" {
+		t.Errorf("best = %q, want the SVG icon to win the format tiebreak", best.URL)
+	}
+}
+
+func TestFilterCandidatesByMinSizeKeepsUnknownSizes(t *testing.T) {
+	candidates := []faviconCandidate{
+		{URL: "https://example.com/16.png", Width: 16, Height: 16},
+		{URL: "https://example.com/unknown.ico"},
+		{URL: "https://example.com/128.png", Width: 128, Height: 128},
+	}
+
+	filtered := filterCandidatesByMinSize(candidates, 64)
+
+	if len(filtered) != 2 {
+		t.Fatalf("filtered = %v, want 2 candidates (unknown size kept, too-small dropped)", filtered)
+	}
+	for _, c := range filtered {
+		if c.URL == "https://example.com/16.png" {
+			t.Errorf("expected the 16x16 candidate to be filtered out below minSize")
+		}
+	}
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	_ "embed"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// fallbackIcon is served whenever favicon discovery or download fails, so
+// callers embedding the proxy endpoint in an <img> tag always get an image
+// back instead of a broken link.
+//
+//go:embed fallback.png
+var fallbackIconBytes []byte
+
+const fallbackContentType = "image/png"
+
+// iconCacheControl is sent for a genuinely discovered icon, which is
+// immutable enough (keyed by site URL, re-fetched on ETag mismatch) to be
+// cached by the client for a full day.
+const iconCacheControl = "max-age=86400"
+
+// CachedImage holds everything handleIconRequest needs to reproduce a prior
+// response without re-fetching the image from upstream.
+type CachedImage struct {
+	ContentType string
+	ETag        string
+	Body        []byte
+}
+
+// imageCache is a concurrency-safe in-memory cache of fetched favicons,
+// keyed by the site URL they were discovered for. When diskDir is set,
+// entries also persist to disk so they survive process restarts.
+type imageCache struct {
+	mu      sync.RWMutex
+	entries map[string]CachedImage
+	diskDir string
+}
+
+func newImageCache(diskDir string) *imageCache {
+	if diskDir != "" {
+		if err := os.MkdirAll(diskDir, 0o755); err != nil {
+			log.Printf("imagecache: could not create cache dir %s: %v", diskDir, err)
+			diskDir = ""
+		}
+	}
+	return &imageCache{
+		entries: make(map[string]CachedImage),
+		diskDir: diskDir,
+	}
+}
+
+func (c *imageCache) get(key string) (CachedImage, bool) {
+	c.mu.RLock()
+	img, ok := c.entries[key]
+	c.mu.RUnlock()
+	if ok {
+		return img, true
+	}
+
+	if c.diskDir == "" {
+		return CachedImage{}, false
+	}
+
+	data, err := ioutil.ReadFile(c.diskPath(key))
+	if err != nil {
+		return CachedImage{}, false
+	}
+
+	var disk struct {
+		ContentType string `json:"contentType"`
+		ETag        string `json:"etag"`
+		Body        []byte `json:"body"`
+	}
+	if err := json.Unmarshal(data, &disk); err != nil {
+		return CachedImage{}, false
+	}
+
+	img = CachedImage{ContentType: disk.ContentType, ETag: disk.ETag, Body: disk.Body}
+	c.mu.Lock()
+	c.entries[key] = img
+	c.mu.Unlock()
+	return img, true
+}
+
+func (c *imageCache) set(key string, img CachedImage) {
+	c.mu.Lock()
+	c.entries[key] = img
+	c.mu.Unlock()
+
+	if c.diskDir == "" {
+		return
+	}
+
+	data, err := json.Marshal(struct {
+		ContentType string `json:"contentType"`
+		ETag        string `json:"etag"`
+		Body        []byte `json:"body"`
+	}{img.ContentType, img.ETag, img.Body})
+	if err != nil {
+		log.Printf("imagecache: could not marshal entry for %s: %v", key, err)
+		return
+	}
+	if err := ioutil.WriteFile(c.diskPath(key), data, 0o644); err != nil {
+		log.Printf("imagecache: could not write disk cache for %s: %v", key, err)
+	}
+}
+
+func (c *imageCache) diskPath(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(c.diskDir, hex.EncodeToString(sum[:])+".json")
+}
+
+// etagFor derives a stable ETag from the image bytes so unchanged icons
+// produce the same ETag across requests and cache reloads.
+func etagFor(body []byte) string {
+	sum := sha256.Sum256(body)
+	return `"` + hex.EncodeToString(sum[:8]) + `"`
+}
+
+// writeCachedImage writes a CachedImage to w with the headers needed for it
+// to be usable directly as an <img src> target, honoring conditional
+// requests via If-None-Match. cacheControl is the literal Cache-Control
+// value to send, since a genuine icon and the fallback need very different
+// lifetimes.
+func writeCachedImage(w http.ResponseWriter, r *http.Request, img CachedImage, cacheControl string) {
+	w.Header().Set("Content-Type", img.ContentType)
+	w.Header().Set("ETag", img.ETag)
+	w.Header().Set("Cache-Control", cacheControl)
+
+	if match := r.Header.Get("If-None-Match"); match != "" && match == img.ETag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write(img.Body)
+}
+
+// fallbackCacheControl caps how long a client caches the bundled fallback
+// icon. It matches negativeCacheTTL rather than the 24h a real icon gets,
+// so a browser that got the fallback during a transient failure re-requests
+// soon enough to pick up the real icon once the server-side
+// negativeResultCache itself expires and discovery is retried - the
+// client-side cache floor can't be longer than the server-side one without
+// leaving the client stuck showing the fallback well after the server has
+// recovered.
+var fallbackCacheControl = fmt.Sprintf("max-age=%d", int(negativeCacheTTL.Seconds()))
+
+// writeFallbackImage writes the bundled fallback icon, used whenever
+// discovery or download of the real favicon fails.
+func writeFallbackImage(w http.ResponseWriter, r *http.Request) {
+	writeCachedImage(w, r, CachedImage{
+		ContentType: fallbackContentType,
+		ETag:        etagFor(fallbackIconBytes),
+		Body:        fallbackIconBytes,
+	}, fallbackCacheControl)
+}
+
+// maxImageBytes caps how much of a fetched image is read, so a URL pointing
+// at a multi-gigabyte response can't be used as a memory-exhaustion DoS.
+const maxImageBytes = 10 * 1024 * 1024
+
+// fetchImage downloads the bytes at imageURL and wraps them in a
+// CachedImage, using the response's Content-Type header when present. The
+// fetch is gated by the shared fetchSemaphore and per-host rate limiter, the
+// same as fetchHTMLContent, and imageURL (plus every redirect hop) is
+// dialed through newGuardedHTTPClient, since imageURL can come from
+// attacker-controlled page content (manifest src, og:image) and must not
+// be usable to reach internal hosts (SSRF).
+func fetchImage(ctx context.Context, imageURL string) (CachedImage, error) {
+	parsedURL, err := url.Parse(imageURL)
+	if err != nil {
+		return CachedImage{}, fmt.Errorf("failed to parse URL: %v", err)
+	}
+
+	release, err := acquireFetchSlot(ctx)
+	if err != nil {
+		return CachedImage{}, fmt.Errorf("canceled while waiting for a fetch slot: %v", err)
+	}
+	defer release()
+
+	if err := fetchHostLimiter.wait(ctx, parsedURL.Hostname()); err != nil {
+		return CachedImage{}, fmt.Errorf("canceled while waiting on host rate limit: %v", err)
+	}
+
+	client := newGuardedHTTPClient(10 * time.Second)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, imageURL, nil)
+	if err != nil {
+		return CachedImage{}, fmt.Errorf("failed to create request: %v", err)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return CachedImage{}, fmt.Errorf("failed to fetch image: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return CachedImage{}, fmt.Errorf("failed to fetch image, status code: %d", resp.StatusCode)
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxImageBytes))
+	if err != nil {
+		return CachedImage{}, fmt.Errorf("failed to read image body: %v", err)
+	}
+
+	contentType := resp.Header.Get("Content-Type")
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	return CachedImage{
+		ContentType: contentType,
+		ETag:        etagFor(body),
+		Body:        body,
+	}, nil
+}
+
+// negativeCacheTTL bounds how long a failed discovery/fetch is remembered
+// for a given site URL, so repeated requests for a URL that can't produce
+// an icon don't re-run the full discovery pipeline (link parse, manifest
+// fetch, up to 5 common-path probes, per-candidate size probes) on every
+// single request - which would otherwise make /icon a repeatable probe
+// against whatever target a crafted page names.
+const negativeCacheTTL = 5 * time.Minute
+
+// negativeResultCache remembers, by site URL, the last time discovery or
+// fetch failed for it. Entries older than negativeCacheTTL are treated as
+// expired and swept out periodically.
+type negativeResultCache struct {
+	mu       sync.Mutex
+	failedAt map[string]time.Time
+}
+
+func newNegativeResultCache() *negativeResultCache {
+	c := &negativeResultCache{failedAt: make(map[string]time.Time)}
+	go c.sweepPeriodically(negativeCacheTTL)
+	return c
+}
+
+func (c *negativeResultCache) markFailed(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.failedAt[key] = time.Now()
+}
+
+// recentlyFailed reports whether key failed within the last negativeCacheTTL.
+func (c *negativeResultCache) recentlyFailed(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	failedAt, ok := c.failedAt[key]
+	if !ok {
+		return false
+	}
+	if time.Since(failedAt) > negativeCacheTTL {
+		delete(c.failedAt, key)
+		return false
+	}
+	return true
+}
+
+func (c *negativeResultCache) sweepPeriodically(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		c.evictExpired()
+	}
+}
+
+func (c *negativeResultCache) evictExpired() {
+	cutoff := time.Now().Add(-negativeCacheTTL)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key, failedAt := range c.failedAt {
+		if failedAt.Before(cutoff) {
+			delete(c.failedAt, key)
+		}
+	}
+}
+
+// iconDiscoveryFailures backs the negative-result short-circuit in
+// handleIconRequest.
+var iconDiscoveryFailures = newNegativeResultCache()
+
+// handleIconRequest fetches the discovered favicon for the given site URL
+// and streams it back directly, so the endpoint can be used as an <img src>
+// without the client making a second, possibly blocked, cross-origin
+// request. Results are cached by site URL to avoid re-fetching upstream;
+// failures are cached too (for a shorter negativeCacheTTL window), so a URL
+// that can't produce an icon doesn't re-run the full discovery pipeline on
+// every request.
+func handleIconRequest(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	siteURL := r.URL.Query().Get("url")
+	if siteURL == "" {
+		http.Error(w, "Missing 'url' query parameter", http.StatusBadRequest)
+		return
+	}
+
+	if cached, ok := iconCache.get(siteURL); ok {
+		writeCachedImage(w, r, cached, iconCacheControl)
+		return
+	}
+
+	if iconDiscoveryFailures.recentlyFailed(siteURL) {
+		writeFallbackImage(w, r)
+		return
+	}
+
+	faviconURL, err := discoverFaviconURL(ctx, siteURL)
+	if err != nil {
+		iconDiscoveryFailures.markFailed(siteURL)
+		writeFallbackImage(w, r)
+		return
+	}
+
+	img, err := fetchImage(ctx, faviconURL)
+	if err != nil {
+		iconDiscoveryFailures.markFailed(siteURL)
+		writeFallbackImage(w, r)
+		return
+	}
+
+	iconCache.set(siteURL, img)
+	writeCachedImage(w, r, img, iconCacheControl)
+}
+
+// discoverFaviconURL resolves the favicon URL for a site the same way
+// processURL does, but returns an error instead of a result map so
+// handleIconRequest can decide how to respond.
+func discoverFaviconURL(ctx context.Context, siteURL string) (string, error) {
+	htmlContent, finalURL, err := fetchHTMLContent(ctx, siteURL)
+	if err != nil {
+		return "", err
+	}
+
+	return parseHTMLForFavicon(ctx, htmlContent, finalURL, 0)
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestImageCacheMemoryRoundTrip(t *testing.T) {
+	cache := newImageCache("")
+
+	img := CachedImage{ContentType: "image/png", ETag: `"abc"`, Body: []byte("bytes")}
+	cache.set("https://example.com", img)
+
+	got, ok := cache.get("https://example.com")
+	if !ok {
+		t.Fatal("get() = false after set(), want true")
+	}
+	if got.ContentType != img.ContentType || got.ETag != img.ETag || string(got.Body) != string(img.Body) {
+		t.Errorf("get() = %+v, want %+v", got, img)
+	}
+
+	if _, ok := cache.get("https://other.example.com"); ok {
+		t.Error("get() for a never-set key = true, want false")
+	}
+}
+
+func TestImageCacheDiskRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+
+	img := CachedImage{ContentType: "image/x-icon", ETag: `"def"`, Body: []byte{0x01, 0x02, 0x03}}
+
+	writer := newImageCache(dir)
+	writer.set("https://example.com/favicon.ico", img)
+
+	// A fresh cache instance backed by the same directory simulates a
+	// restart: the entry must come back from disk, not memory.
+	reader := newImageCache(dir)
+	got, ok := reader.get("https://example.com/favicon.ico")
+	if !ok {
+		t.Fatal("get() = false after restart, want true (entry should load from disk)")
+	}
+	if got.ContentType != img.ContentType || got.ETag != img.ETag || string(got.Body) != string(img.Body) {
+		t.Errorf("get() after restart = %+v, want %+v", got, img)
+	}
+}
+
+func TestWriteCachedImageServesBody(t *testing.T) {
+	img := CachedImage{ContentType: "image/png", ETag: `"xyz"`, Body: []byte("png-bytes")}
+
+	req := httptest.NewRequest(http.MethodGet, "/icon?url=https://example.com", nil)
+	w := httptest.NewRecorder()
+
+	writeCachedImage(w, req, img, iconCacheControl)
+
+	resp := w.Result()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("status = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	if got := resp.Header.Get("ETag"); got != img.ETag {
+		t.Errorf("ETag header = %q, want %q", got, img.ETag)
+	}
+	if w.Body.String() != string(img.Body) {
+		t.Errorf("body = %q, want %q", w.Body.String(), string(img.Body))
+	}
+}
+
+func TestWriteCachedImageHonorsIfNoneMatch(t *testing.T) {
+	img := CachedImage{ContentType: "image/png", ETag: `"xyz"`, Body: []byte("png-bytes")}
+
+	req := httptest.NewRequest(http.MethodGet, "/icon?url=https://example.com", nil)
+	req.Header.Set("If-None-Match", img.ETag)
+	w := httptest.NewRecorder()
+
+	writeCachedImage(w, req, img, iconCacheControl)
+
+	resp := w.Result()
+	if resp.StatusCode != http.StatusNotModified {
+		t.Errorf("status = %d, want %d", resp.StatusCode, http.StatusNotModified)
+	}
+	if w.Body.Len() != 0 {
+		t.Errorf("body = %q, want empty on 304", w.Body.String())
+	}
+}
+
+func TestWriteFallbackImageUsesShortLivedCacheControl(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/icon?url=https://example.com", nil)
+	w := httptest.NewRecorder()
+
+	writeFallbackImage(w, req)
+
+	resp := w.Result()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("status = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	if got := resp.Header.Get("Cache-Control"); got != fallbackCacheControl {
+		t.Errorf("Cache-Control = %q, want %q", got, fallbackCacheControl)
+	}
+	if got := resp.Header.Get("Cache-Control"); got == iconCacheControl {
+		t.Error("fallback response reused the 24h icon Cache-Control, want a short-lived value so clients re-check once discovery recovers")
+	}
+}
+
+func TestNegativeResultCacheRemembersFailureUntilTTL(t *testing.T) {
+	c := newNegativeResultCache()
+
+	if c.recentlyFailed("https://example.com") {
+		t.Fatal("recentlyFailed() = true before any markFailed(), want false")
+	}
+
+	c.markFailed("https://example.com")
+	if !c.recentlyFailed("https://example.com") {
+		t.Error("recentlyFailed() = false right after markFailed(), want true")
+	}
+
+	c.mu.Lock()
+	c.failedAt["https://example.com"] = time.Now().Add(-2 * negativeCacheTTL)
+	c.mu.Unlock()
+
+	if c.recentlyFailed("https://example.com") {
+		t.Error("recentlyFailed() = true for an entry past negativeCacheTTL, want false")
+	}
+}
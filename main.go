@@ -5,16 +5,17 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
-
-	"golang.org/x/net/html"
 )
 
 // Constants for timeouts
@@ -24,6 +25,14 @@ const (
 	idleTimeout  = 60 * time.Second
 )
 
+// maxHTMLBytes caps how much of a fetched page is read, so a malicious or
+// misbehaving upstream can't exhaust memory by streaming an unbounded body.
+const maxHTMLBytes = 2 * 1024 * 1024
+
+// iconCache backs the /icon endpoint. It always caches in memory and, when
+// CACHE_DIR is set, also persists entries to disk so they survive restarts.
+var iconCache = newImageCache(os.Getenv("CACHE_DIR"))
+
 // addHTTPPrefix ensures the URL has a valid scheme (http or https)
 func addHTTPPrefix(url string) string {
 	if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
@@ -38,134 +47,80 @@ func isValidURL(url string) bool {
 	return strings.HasPrefix(url, "http://") || strings.HasPrefix(url, "https://")
 }
 
-// fetchHTMLContent fetches the HTML content from the given URL with retries and timeouts
-func fetchHTMLContent(ctx context.Context, url string) (string, error) {
-	url = addHTTPPrefix(url)
-	if !isValidURL(url) {
-		return "", errors.New("invalid URL")
-	}
-
-	client := &http.Client{
-		Timeout: 10 * time.Second,
-	}
-
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+// fetchHTMLContent fetches the HTML content from the given URL with retries and timeouts.
+// It follows redirects and also returns the final request URL, since sites
+// that redirect (e.g. http -> https, or onto a www subdomain) need relative
+// favicon hrefs resolved against where the page actually ended up, not the
+// URL the caller originally asked for. The fetch waits for a free slot in
+// fetchSemaphore and for its host's rate limiter before hitting the network,
+// so a batch request spanning many URLs can't exhaust file descriptors or
+// hammer a single upstream host. rawURL, and every redirect hop, is dialed
+// through newGuardedHTTPClient, since this is a public endpoint and the
+// URL is directly caller-controlled (SSRF guard).
+func fetchHTMLContent(ctx context.Context, rawURL string) (string, *url.URL, error) {
+	rawURL = addHTTPPrefix(rawURL)
+	if !isValidURL(rawURL) {
+		return "", nil, errors.New("invalid URL")
+	}
+
+	parsedURL, err := url.Parse(rawURL)
 	if err != nil {
-		return "", fmt.Errorf("failed to create request: %v", err)
+		return "", nil, fmt.Errorf("failed to parse URL: %v", err)
 	}
 
-	resp, err := client.Do(req)
+	release, err := acquireFetchSlot(ctx)
 	if err != nil {
-		return "", fmt.Errorf("failed to fetch page: %v", err)
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("failed to fetch page, status code: %d", resp.StatusCode)
+		return "", nil, fmt.Errorf("canceled while waiting for a fetch slot: %v", err)
 	}
+	defer release()
 
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return "", fmt.Errorf("failed to read response body: %v", err)
+	if err := fetchHostLimiter.wait(ctx, parsedURL.Hostname()); err != nil {
+		return "", nil, fmt.Errorf("canceled while waiting on host rate limit: %v", err)
 	}
 
-	return string(body), nil
-}
+	client := newGuardedHTTPClient(10 * time.Second)
 
-// parseHTMLForFavicon parses the HTML to find the most likely favicon URL
-func parseHTMLForFavicon(htmlContent string, baseURL string) (string, error) {
-	doc, err := html.Parse(strings.NewReader(htmlContent))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
 	if err != nil {
-		return "", fmt.Errorf("failed to parse HTML: %v", err)
+		return "", nil, fmt.Errorf("failed to create request: %v", err)
 	}
 
-	var faviconURL string
-	var largestIconURL string
-	var f func(*html.Node)
-	f = func(n *html.Node) {
-		if n.Type == html.ElementNode && n.Data == "link" {
-			var rel, href string
-			var sizeAttr string
-			for _, attr := range n.Attr {
-				switch attr.Key {
-				case "rel":
-					rel = attr.Val
-				case "href":
-					href = attr.Val
-				case "sizes":
-					sizeAttr = attr.Val
-				}
-			}
-
-			// Prioritize rel="icon" and rel="shortcut icon"
-			if strings.Contains(rel, "icon") && href != "" {
-				if strings.HasPrefix(href, "/") && !strings.HasPrefix(href, "//") {
-					href = baseURL + href
-				} else if strings.HasPrefix(href, "//") {
-					href = "http:" + href
-				}
-
-				// Check for largest icon if sizes are available
-				if rel == "icon" && sizeAttr != "" {
-					largestIconURL = href // Update to largest icon URL
-				}
-
-				// Set faviconURL to the first icon we find
-				if faviconURL == "" {
-					faviconURL = href
-				}
-			}
-		}
-
-		for c := n.FirstChild; c != nil; c = c.NextSibling {
-			f(c)
-		}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to fetch page: %v", err)
 	}
+	defer resp.Body.Close()
 
-	f(doc)
-
-	// Prefer the largest icon URL if available
-	if largestIconURL != "" {
-		return largestIconURL, nil
+	if resp.StatusCode != http.StatusOK {
+		return "", nil, fmt.Errorf("failed to fetch page, status code: %d", resp.StatusCode)
 	}
 
-	if faviconURL == "" {
-		// If no favicon is found in the HTML, try a common fallback
-		return baseURL + "/favicon.ico", nil
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxHTMLBytes))
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to read response body: %v", err)
 	}
 
-	return faviconURL, nil
-}
-
-// getBaseURL extracts the base URL from a full URL
-func getBaseURL(url string) string {
-	splitIndex := strings.Index(url, "//") + 2
-	endIndex := strings.Index(url[splitIndex:], "/")
-	if endIndex != -1 {
-		return url[:splitIndex+endIndex]
-	}
-	return url
+	return string(body), resp.Request.URL, nil
 }
 
-// processURL processes a single URL, fetches its favicon, and sends the result back via a channel
-func processURL(ctx context.Context, url string, ch chan<- map[string]interface{}) {
+// processURL processes a single URL, fetches its favicon, and sends the result back via a channel.
+// minSize, if positive, requires the chosen icon to be at least minSize×minSize.
+func processURL(ctx context.Context, url string, minSize int, ch chan<- map[string]interface{}) {
 	result := map[string]interface{}{
 		"url":     url,
 		"icon":    "",
 		"success": 0,
 	}
 
-	// Fetch HTML content for the URL
-	htmlContent, err := fetchHTMLContent(ctx, url)
+	// Fetch HTML content for the URL, following any redirects
+	htmlContent, finalURL, err := fetchHTMLContent(ctx, url)
 	if err != nil {
 		result["success"] = 0
 		result["icon"] = ""
 	} else {
-		// Get the base URL to handle relative favicon paths
-		baseURL := getBaseURL(url)
-
-		// Parse the HTML to find the favicon URL
-		faviconURL, err := parseHTMLForFavicon(htmlContent, baseURL)
+		// Parse the HTML to find the favicon URL, resolving relative hrefs
+		// against the post-redirect URL
+		faviconURL, err := parseHTMLForFavicon(ctx, htmlContent, finalURL, minSize)
 		if err != nil {
 			result["success"] = 0
 			result["icon"] = ""
@@ -191,6 +146,14 @@ func handleRequest(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// minSize lets callers require an icon of at least minSize×minSize
+	minSize := 0
+	if raw := r.URL.Query().Get("minSize"); raw != "" {
+		if parsed, err := strconv.Atoi(raw); err == nil {
+			minSize = parsed
+		}
+	}
+
 	// Channel to collect results
 	resultsCh := make(chan map[string]interface{}, len(urls))
 	var wg sync.WaitGroup
@@ -200,7 +163,7 @@ func handleRequest(w http.ResponseWriter, r *http.Request) {
 		wg.Add(1)
 		go func(url string) {
 			defer wg.Done()
-			processURL(ctx, url, resultsCh)
+			processURL(ctx, url, minSize, resultsCh)
 		}(url)
 	}
 
@@ -233,13 +196,17 @@ func writeJSONResponse(w http.ResponseWriter, statusCode int, data interface{})
 
 // main starts the HTTP server and handles graceful shutdown
 func main() {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", rateLimitMiddleware(handleRequest))
+	mux.HandleFunc("/icon", rateLimitMiddleware(handleIconRequest))
+
 	// Set up the server with timeouts and graceful shutdown
 	srv := &http.Server{
 		Addr:         ":8080",
 		ReadTimeout:  readTimeout,
 		WriteTimeout: writeTimeout,
 		IdleTimeout:  idleTimeout,
-		Handler:      http.TimeoutHandler(http.HandlerFunc(handleRequest), 5*time.Second, "Request timed out"),
+		Handler:      http.TimeoutHandler(mux, 5*time.Second, "Request timed out"),
 	}
 
 	// Run the server in a goroutine to allow graceful shutdown
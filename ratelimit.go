@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// defaultMaxConcurrentFetches bounds how many upstream fetches (HTML pages
+// or images) run at once when MAX_CONCURRENT_FETCHES is unset or invalid.
+const defaultMaxConcurrentFetches = 20
+
+// fetchSemaphore bounds the number of in-flight upstream fetches across all
+// requests, so a client passing thousands of URLs to / can't spawn unbounded
+// outgoing connections and exhaust file descriptors.
+var fetchSemaphore = make(chan struct{}, maxConcurrentFetches())
+
+func maxConcurrentFetches() int {
+	if raw := os.Getenv("MAX_CONCURRENT_FETCHES"); raw != "" {
+		if parsed, err := strconv.Atoi(raw); err == nil && parsed > 0 {
+			return parsed
+		}
+	}
+	return defaultMaxConcurrentFetches
+}
+
+// acquireFetchSlot blocks until a fetch slot is free or ctx is done. The
+// returned release func must be called once the fetch completes.
+func acquireFetchSlot(ctx context.Context) (release func(), err error) {
+	select {
+	case fetchSemaphore <- struct{}{}:
+		return func() { <-fetchSemaphore }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+const (
+	// limiterTTL is how long a per-host or per-IP limiter is kept after its
+	// last use before being evicted, so a long-running public deployment
+	// doesn't accumulate one limiter per host/IP ever seen for the life of
+	// the process.
+	limiterTTL = 10 * time.Minute
+
+	// limiterSweepInterval is how often expired limiters are swept out.
+	limiterSweepInterval = 5 * time.Minute
+)
+
+// limiterEntry pairs a rate.Limiter with the last time it was handed out,
+// so evictingLimiterSet's sweep can tell which entries have gone idle.
+type limiterEntry struct {
+	limiter  *rate.Limiter
+	lastUsed time.Time
+}
+
+// evictingLimiterSet hands out a *rate.Limiter per key, creating one (via
+// newLimiter) on first use, and evicts entries that haven't been used in
+// limiterTTL so the map doesn't grow without bound over the life of a
+// long-running process.
+type evictingLimiterSet struct {
+	mu         sync.Mutex
+	entries    map[string]*limiterEntry
+	newLimiter func() *rate.Limiter
+}
+
+func newEvictingLimiterSet(newLimiter func() *rate.Limiter) *evictingLimiterSet {
+	s := &evictingLimiterSet{
+		entries:    make(map[string]*limiterEntry),
+		newLimiter: newLimiter,
+	}
+	go s.sweepPeriodically(limiterSweepInterval)
+	return s
+}
+
+func (s *evictingLimiterSet) get(key string) *rate.Limiter {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, ok := s.entries[key]
+	if !ok {
+		entry = &limiterEntry{limiter: s.newLimiter()}
+		s.entries[key] = entry
+	}
+	entry.lastUsed = time.Now()
+	return entry.limiter
+}
+
+// sweepPeriodically evicts entries idle for longer than limiterTTL, once
+// per interval, until the process exits.
+func (s *evictingLimiterSet) sweepPeriodically(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		s.evictExpired()
+	}
+}
+
+func (s *evictingLimiterSet) evictExpired() {
+	cutoff := time.Now().Add(-limiterTTL)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key, entry := range s.entries {
+		if entry.lastUsed.Before(cutoff) {
+			delete(s.entries, key)
+		}
+	}
+}
+
+// perHostRate and perHostBurst throttle fetches to a single upstream host,
+// so a batch of URLs that resolve to the same site get serialized/throttled
+// instead of hammering it concurrently.
+const (
+	perHostRate  = 2
+	perHostBurst = 4
+)
+
+// hostLimiter hands out a per-host token-bucket limiter. It is consulted by
+// every fetch path (fetchHTMLContent, fetchImage, commonPathCandidates,
+// fetchBytes, probeImageDimensions) before they hit the network.
+type hostLimiter struct {
+	set *evictingLimiterSet
+}
+
+var fetchHostLimiter = &hostLimiter{
+	set: newEvictingLimiterSet(func() *rate.Limiter {
+		return rate.NewLimiter(rate.Limit(perHostRate), perHostBurst)
+	}),
+}
+
+// wait blocks until host's bucket has a token to spend, or ctx is done.
+func (h *hostLimiter) wait(ctx context.Context, host string) error {
+	return h.set.get(host).Wait(ctx)
+}
+
+// requestsPerSecondPerIP and requestBurstPerIP bound how often a single
+// client IP may hit any endpoint, so the service can be exposed publicly
+// without being trivially abused.
+const (
+	requestsPerSecondPerIP = 5
+	requestBurstPerIP      = 10
+)
+
+// ipLimiter hands out a per-client-IP token-bucket limiter. Unlike
+// hostLimiter it checks Allow rather than waiting, since a rejected request
+// should fail fast with 429 rather than stall.
+type ipLimiter struct {
+	set *evictingLimiterSet
+}
+
+var clientIPLimiter = &ipLimiter{
+	set: newEvictingLimiterSet(func() *rate.Limiter {
+		return rate.NewLimiter(rate.Limit(requestsPerSecondPerIP), requestBurstPerIP)
+	}),
+}
+
+func (l *ipLimiter) allow(ip string) bool {
+	return l.set.get(ip).Allow()
+}
+
+// clientIP extracts the request's client IP from RemoteAddr, stripping the
+// port if present.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// rateLimitMiddleware rejects requests once a client IP exceeds its request
+// rate, returning 429 Too Many Requests with a Retry-After header.
+func rateLimitMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !clientIPLimiter.allow(clientIP(r)) {
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "Too many requests", http.StatusTooManyRequests)
+			return
+		}
+		next(w, r)
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+func TestAcquireFetchSlotBlocksAtCapacity(t *testing.T) {
+	capacity := cap(fetchSemaphore)
+
+	releases := make([]func(), 0, capacity)
+	for i := 0; i < capacity; i++ {
+		release, err := acquireFetchSlot(context.Background())
+		if err != nil {
+			t.Fatalf("acquireFetchSlot() #%d returned error: %v", i, err)
+		}
+		releases = append(releases, release)
+	}
+	defer func() {
+		for _, release := range releases {
+			release()
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	if _, err := acquireFetchSlot(ctx); err == nil {
+		t.Error("acquireFetchSlot() at full capacity = nil error, want context deadline error")
+	}
+
+	releases[0]()
+	releases = releases[1:]
+
+	if release, err := acquireFetchSlot(context.Background()); err != nil {
+		t.Errorf("acquireFetchSlot() after a release returned error: %v", err)
+	} else {
+		release()
+	}
+}
+
+func TestHostLimiterThrottlesPastBurst(t *testing.T) {
+	host := "throttle-test-host.example"
+
+	for i := 0; i < perHostBurst; i++ {
+		if err := fetchHostLimiter.wait(context.Background(), host); err != nil {
+			t.Fatalf("wait() #%d within burst returned error: %v", i, err)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	if err := fetchHostLimiter.wait(ctx, host); err == nil {
+		t.Error("wait() past the burst = nil error, want context deadline error")
+	}
+}
+
+func TestEvictingLimiterSetEvictsIdleEntries(t *testing.T) {
+	set := newEvictingLimiterSet(func() *rate.Limiter {
+		return rate.NewLimiter(rate.Limit(perHostRate), perHostBurst)
+	})
+
+	set.get("stale-key")
+
+	set.mu.Lock()
+	entry := set.entries["stale-key"]
+	entry.lastUsed = time.Now().Add(-2 * limiterTTL)
+	set.mu.Unlock()
+
+	set.evictExpired()
+
+	set.mu.Lock()
+	_, stillPresent := set.entries["stale-key"]
+	set.mu.Unlock()
+
+	if stillPresent {
+		t.Error("evictExpired() left an entry idle for longer than limiterTTL, want it evicted")
+	}
+}
+
+func TestRateLimitMiddlewareReturns429PastBurst(t *testing.T) {
+	handler := rateLimitMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	remoteAddr := "198.51.100.7:54321"
+
+	for i := 0; i < requestBurstPerIP; i++ {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = remoteAddr
+		w := httptest.NewRecorder()
+
+		handler(w, req)
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("request #%d status = %d, want %d", i, w.Code, http.StatusOK)
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = remoteAddr
+	w := httptest.NewRecorder()
+
+	handler(w, req)
+
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("status past burst = %d, want %d", w.Code, http.StatusTooManyRequests)
+	}
+	if w.Header().Get("Retry-After") == "" {
+		t.Error("Retry-After header missing on 429 response")
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	cases := []struct {
+		name       string
+		remoteAddr string
+		want       string
+	}{
+		{name: "host and port", remoteAddr: "203.0.113.9:12345", want: "203.0.113.9"},
+		{name: "no port", remoteAddr: "203.0.113.9", want: "203.0.113.9"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = tc.remoteAddr
+
+			if got := clientIP(req); got != tc.want {
+				t.Errorf("clientIP() = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}